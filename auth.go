@@ -0,0 +1,229 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Authenticator applies credentials to an outgoing request and observes
+// the response afterward, so that authenticators which cache state (an
+// OIDC access token, a Vault-sourced secret) can invalidate it and ask
+// for a single retry when the server rejects it.
+type Authenticator interface {
+	// Apply sets whatever headers are needed to authenticate req.
+	Apply(req *retryablehttp.Request) error
+	// OnResponse inspects resp after it comes back and returns true if
+	// the authenticator invalidated its cached credential and the
+	// request should be retried once with a freshly Apply-ed one.
+	OnResponse(resp *http.Response) bool
+}
+
+// Auth is the original basic-auth credential pair. It satisfies
+// Authenticator directly so existing callers that set HTTPRequest.Auth
+// to a *Auth continue to work unchanged.
+type Auth struct {
+	Username string
+	Password string
+}
+
+func (a *Auth) Apply(req *retryablehttp.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+func (a *Auth) OnResponse(resp *http.Response) bool {
+	return false
+}
+
+// BearerToken authenticates with a static bearer token, e.g. a
+// pre-issued service token.
+type BearerToken struct {
+	Token string
+}
+
+func (b *BearerToken) Apply(req *retryablehttp.Request) error {
+	req.Header.Set("Authorization", "Bearer "+b.Token)
+	return nil
+}
+
+func (b *BearerToken) OnResponse(resp *http.Response) bool {
+	return false
+}
+
+// OIDCClientCredentials authenticates using the OAuth2 client-credentials
+// grant, caching the access token until it expires and fetching a fresh
+// one on the first 401/403 it sees.
+type OIDCClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+
+	// Client is used to call TokenURL. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	mu    sync.Mutex
+	token string
+	exp   time.Time
+}
+
+func (o *OIDCClientCredentials) Apply(req *retryablehttp.Request) error {
+	token, err := o.currentToken()
+	if err != nil {
+		return fmt.Errorf("error fetching OIDC token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (o *OIDCClientCredentials) OnResponse(resp *http.Response) bool {
+	if resp == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return false
+	}
+	o.mu.Lock()
+	o.token = ""
+	o.mu.Unlock()
+	return true
+}
+
+func (o *OIDCClientCredentials) currentToken() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token != "" && time.Now().Before(o.exp) {
+		return o.token, nil
+	}
+
+	token, exp, err := o.fetchToken()
+	if err != nil {
+		return "", err
+	}
+	o.token, o.exp = token, exp
+	return token, nil
+}
+
+func (o *OIDCClientCredentials) fetchToken() (string, time.Time, error) {
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", o.ClientID)
+	form.Set("client_secret", o.ClientSecret)
+	if o.Scope != "" {
+		form.Set("scope", o.Scope)
+	}
+
+	resp, err := client.PostForm(o.TokenURL, form)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint '%s' returned status %d", o.TokenURL, resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, fmt.Errorf("error decoding token response: %v", err)
+	}
+
+	return body.AccessToken, time.Now().Add(time.Duration(body.ExpiresIn) * time.Second), nil
+}
+
+// VaultLookup abstracts the hms-securestorage adapter so VaultSourced can
+// be unit tested without a live Vault.
+type VaultLookup interface {
+	Lookup(key string, output interface{}) error
+}
+
+// VaultSourced pulls basic-auth credentials from a Vault KV path at
+// request time via Storage, re-fetching them on every Apply so a
+// credential rotated in Vault takes effect on the next request without
+// restarting the caller.
+type VaultSourced struct {
+	Storage VaultLookup
+	KeyPath string
+}
+
+func (v *VaultSourced) Apply(req *retryablehttp.Request) error {
+	var creds struct {
+		Username string `json:"Username"`
+		Password string `json:"Password"`
+	}
+	if err := v.Storage.Lookup(v.KeyPath, &creds); err != nil {
+		return fmt.Errorf("error looking up Vault credential '%s': %v", v.KeyPath, err)
+	}
+	req.SetBasicAuth(creds.Username, creds.Password)
+	return nil
+}
+
+func (v *VaultSourced) OnResponse(resp *http.Response) bool {
+	return false
+}
+
+// wrapAuthRetry wraps client.CheckRetry so that the first 401/403 seen
+// for req.Auth triggers exactly one re-Apply of a freshly-fetched
+// credential before falling through to the client's existing retry
+// policy. retryablehttp reuses the same *http.Request across attempts,
+// so headers set here carry over to the next attempt it makes. client is
+// always send's private per-call copy, so the wrapping here never leaks
+// into a caller-supplied client or a sibling request sharing the same
+// TLSClientPair.
+func (req *HTTPRequest) wrapAuthRetry(client *retryablehttp.Client) {
+	if req.Auth == nil {
+		return
+	}
+
+	prevCheckRetry := client.CheckRetry
+	if prevCheckRetry == nil {
+		prevCheckRetry = retryablehttp.DefaultRetryPolicy
+	}
+
+	retried := false
+	client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if !retried && resp != nil && req.Auth.OnResponse(resp) {
+			retried = true
+			if applyErr := req.Auth.Apply(&retryablehttp.Request{Request: resp.Request}); applyErr != nil {
+				return false, applyErr
+			}
+			return true, nil
+		}
+		return prevCheckRetry(ctx, resp, err)
+	}
+}
@@ -0,0 +1,126 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBearerTokenSetsAuthorizationHeader(t *testing.T) {
+	var gotHeader string
+	tserv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(jpayload))
+	}))
+	defer tserv.Close()
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Auth = &BearerToken{Token: "s3cr3t"}
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+	if gotHeader != "Bearer s3cr3t" {
+		t.Errorf("ERROR expected 'Bearer s3cr3t', got '%s'", gotHeader)
+	}
+}
+
+func TestVaultSourcedAppliesBasicAuthFromLookup(t *testing.T) {
+	var gotUser, gotPass string
+	tserv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(jpayload))
+	}))
+	defer tserv.Close()
+
+	lookups := int32(0)
+	storage := vaultLookupFunc(func(key string, output interface{}) error {
+		atomic.AddInt32(&lookups, 1)
+		creds := output.(*struct {
+			Username string `json:"Username"`
+			Password string `json:"Password"`
+		})
+		creds.Username = "vault-user"
+		creds.Password = "vault-pass"
+		return nil
+	})
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Auth = &VaultSourced{Storage: storage, KeyPath: "secret/smd/creds"}
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+	if gotUser != "vault-user" || gotPass != "vault-pass" {
+		t.Errorf("ERROR expected vault-sourced creds, got user='%s' pass='%s'", gotUser, gotPass)
+	}
+	if atomic.LoadInt32(&lookups) != 1 {
+		t.Errorf("ERROR expected exactly 1 Vault lookup, got %d", lookups)
+	}
+}
+
+type vaultLookupFunc func(key string, output interface{}) error
+
+func (f vaultLookupFunc) Lookup(key string, output interface{}) error { return f(key, output) }
+
+func TestOIDCClientCredentialsRetriesOnceOn401(t *testing.T) {
+	var issued int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"tok%d","expires_in":3600}`, n)
+	}))
+	defer tokenServer.Close()
+
+	var attempts int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if r.Header.Get("Authorization") == "Bearer tok1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(jpayload))
+	}))
+	defer apiServer.Close()
+
+	req := NewHTTPRequest(apiServer.URL)
+	req.ExpectedStatusCodes = []int{http.StatusOK}
+	req.Auth = &OIDCClientCredentials{TokenURL: tokenServer.URL, ClientID: "id", ClientSecret: "secret"}
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("ERROR expected exactly 2 attempts against the API server (1 stale token + 1 refreshed), got %d", attempts)
+	}
+	if atomic.LoadInt32(&issued) != 2 {
+		t.Errorf("ERROR expected exactly 2 tokens issued (initial + refresh after 401), got %d", issued)
+	}
+}
@@ -0,0 +1,298 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// ErrCircuitOpen is returned by DoHTTPAction/DoStreamingHTTPAction instead
+// of attempting a request at all, when the target host's CircuitBreaker
+// is tripped. Callers can check for it with errors.Is to fail fast
+// instead of waiting out MaxRetryCount against a known-down peer.
+var ErrCircuitOpen = errors.New("circuit breaker open for host")
+
+// BreakerState is one of the three states a CircuitBreaker can be in.
+type BreakerState int
+
+const (
+	// BreakerClosed is the normal state: requests are allowed through and
+	// their results are counted toward the failure ratio.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every request until the cooldown expires.
+	BreakerOpen
+	// BreakerHalfOpen allows a single probe request through to decide
+	// whether to return to BreakerClosed or trip back to BreakerOpen.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Defaults used by NewCircuitBreaker.
+const (
+	DefaultFailureThreshold = 0.5
+	DefaultMinRequests      = 5
+	DefaultCooldownBase     = 1 * time.Second
+	DefaultCooldownMax      = 2 * time.Minute
+)
+
+// CircuitBreaker trips for a single target once its failure ratio over a
+// minimum sample size crosses FailureThreshold, then rejects requests
+// until an exponentially growing cooldown elapses, at which point it
+// lets exactly one probe request through (BreakerHalfOpen) to decide
+// whether the target has recovered.
+type CircuitBreaker struct {
+	FailureThreshold float64
+	MinRequests      int
+	CooldownBase     time.Duration
+	CooldownMax      time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	successes int
+	failures  int
+	trips     int
+	openUntil time.Time
+}
+
+// NewCircuitBreaker creates a CircuitBreaker with the package defaults:
+// trip once at least DefaultMinRequests have been seen and
+// DefaultFailureThreshold of them failed, cooling down from
+// DefaultCooldownBase up to DefaultCooldownMax.
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: DefaultFailureThreshold,
+		MinRequests:      DefaultMinRequests,
+		CooldownBase:     DefaultCooldownBase,
+		CooldownMax:      DefaultCooldownMax,
+	}
+}
+
+// Allow reports whether a request may proceed. An open breaker allows
+// nothing until its cooldown elapses, at which point it moves to
+// BreakerHalfOpen and allows exactly one probe through; every other
+// caller is rejected while that probe is outstanding, so RecordResult
+// can resolve it before a second one is let through.
+func (b *CircuitBreaker) Allow() bool {
+	allowed, _ := b.allow()
+	return allowed
+}
+
+// allow is Allow's implementation, additionally reporting the state the
+// breaker was in immediately before the decision, so a caller can report
+// an accurate from/to state transition without a second, separately
+// locked read racing a concurrent RecordResult.
+func (b *CircuitBreaker) allow() (bool, BreakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	before := b.state
+	switch b.state {
+	case BreakerClosed:
+		return true, before
+	case BreakerHalfOpen:
+		// A probe is already outstanding; don't let a second one race it.
+		return false, before
+	default: // BreakerOpen
+		if time.Now().Before(b.openUntil) {
+			return false, before
+		}
+		b.state = BreakerHalfOpen
+		return true, before
+	}
+}
+
+// RecordResult feeds the outcome of a request allowed through by Allow
+// back into the breaker, and returns the state the breaker is in
+// afterward. A failed probe from BreakerHalfOpen trips the breaker again
+// with a longer cooldown; a successful one resets it to BreakerClosed.
+func (b *CircuitBreaker) RecordResult(success bool) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		if success {
+			b.reset()
+		} else {
+			b.trip()
+		}
+		return b.state
+	}
+
+	if success {
+		b.successes++
+	} else {
+		b.failures++
+	}
+
+	if total := b.successes + b.failures; total >= b.MinRequests {
+		if float64(b.failures)/float64(total) >= b.FailureThreshold {
+			b.trip()
+		}
+	}
+	return b.state
+}
+
+// State reports the breaker's current state.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) trip() {
+	b.trips++
+	cooldown := b.CooldownBase * time.Duration(math.Pow(2, float64(b.trips-1)))
+	if b.CooldownMax > 0 && cooldown > b.CooldownMax {
+		cooldown = b.CooldownMax
+	}
+	b.openUntil = time.Now().Add(cooldown)
+	b.state = BreakerOpen
+}
+
+func (b *CircuitBreaker) reset() {
+	b.trips = 0
+	b.successes, b.failures = 0, 0
+	b.state = BreakerClosed
+}
+
+// CircuitBreakerRegistry hands out a CircuitBreaker per target host,
+// creating one with the package defaults the first time it's asked for.
+type CircuitBreakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewCircuitBreakerRegistry creates an empty CircuitBreakerRegistry.
+func NewCircuitBreakerRegistry() *CircuitBreakerRegistry {
+	return &CircuitBreakerRegistry{breakers: make(map[string]*CircuitBreaker)}
+}
+
+// Get returns the CircuitBreaker for host, creating one if this is the
+// first time host has been seen.
+func (r *CircuitBreakerRegistry) Get(host string) *CircuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.breakers[host]
+	if !ok {
+		b = NewCircuitBreaker()
+		r.breakers[host] = b
+	}
+	return b
+}
+
+// DefaultCircuitBreakers is the process-wide registry used for any
+// HTTPRequest that doesn't set its own CircuitBreaker, so every caller in
+// a process sharing a target host shares its trip/cooldown state instead
+// of each re-deriving its own storm-avoidance logic.
+var DefaultCircuitBreakers = NewCircuitBreakerRegistry()
+
+// breaker returns req.CircuitBreaker if set, otherwise the
+// DefaultCircuitBreakers entry for host.
+func (req *HTTPRequest) breaker(host string) *CircuitBreaker {
+	if req.CircuitBreaker != nil {
+		return req.CircuitBreaker
+	}
+	return DefaultCircuitBreakers.Get(host)
+}
+
+// applyAdaptiveRetryPolicy installs AdaptiveRetryPolicy/AdaptiveBackoff on
+// client, which is always send's private per-call copy. It only does so
+// for a client the package itself constructed (req.Client unset); a
+// caller that built and wired up its own *retryablehttp.Client is assumed
+// to have already chosen the retry/backoff behavior it wants, and keeps
+// it untouched.
+func (req *HTTPRequest) applyAdaptiveRetryPolicy(client *retryablehttp.Client) {
+	if req.Client != nil {
+		return
+	}
+
+	client.CheckRetry = AdaptiveRetryPolicy
+	client.Backoff = AdaptiveBackoff
+}
+
+// AdaptiveRetryPolicy extends retryablehttp.DefaultRetryPolicy to also
+// retry on 429 Too Many Requests, which DefaultRetryPolicy treats as a
+// non-retryable client error.
+func AdaptiveRetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true, nil
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// AdaptiveBackoff is a retryablehttp.Backoff that honors a Retry-After
+// response header on 429/503 responses, the way Vault's client and
+// Azure's autorest do, clamped to [min, max]. It falls back to
+// retryablehttp.DefaultBackoff's exponential backoff for anything else.
+func AdaptiveBackoff(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := retryAfter(resp); ok {
+			switch {
+			case wait < min:
+				return min
+			case wait > max:
+				return max
+			default:
+				return wait
+			}
+		}
+	}
+	return retryablehttp.DefaultBackoff(min, max, attempt, resp)
+}
+
+// retryAfter parses a Retry-After header as either a number of seconds
+// or an HTTP-date, per RFC 7231 section 7.1.3.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(h); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait, true
+		}
+	}
+	return 0, false
+}
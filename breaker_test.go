@@ -0,0 +1,162 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTripsAfterFailureRatio(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.MinRequests = 4
+	b.FailureThreshold = 0.5
+
+	b.RecordResult(true)
+	b.RecordResult(false)
+	b.RecordResult(true)
+	if !b.Allow() {
+		t.Fatalf("ERROR breaker tripped before MinRequests reached")
+	}
+	b.RecordResult(false)
+
+	if b.State() != BreakerOpen {
+		t.Fatalf("ERROR expected BreakerOpen after 2/4 failures, got %s", b.State())
+	}
+	if b.Allow() {
+		t.Errorf("ERROR expected Allow() to reject while cooldown is active")
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbeRecovers(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.MinRequests = 1
+	b.FailureThreshold = 0.5
+	b.CooldownBase = 10 * time.Millisecond
+
+	b.RecordResult(false)
+	if b.State() != BreakerOpen {
+		t.Fatalf("ERROR expected BreakerOpen after single failure, got %s", b.State())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("ERROR expected Allow() to admit a probe once cooldown elapsed")
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("ERROR expected BreakerHalfOpen after cooldown, got %s", b.State())
+	}
+
+	if got := b.RecordResult(true); got != BreakerClosed {
+		t.Errorf("ERROR expected a successful probe to close the breaker, got %s", got)
+	}
+}
+
+func TestCircuitBreakerHalfOpenAllowsOnlyOneConcurrentProbe(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.MinRequests = 1
+	b.FailureThreshold = 0.5
+	b.CooldownBase = 10 * time.Millisecond
+
+	b.RecordResult(false)
+	time.Sleep(20 * time.Millisecond)
+
+	admitted := 0
+	for i := 0; i < 5; i++ {
+		if b.Allow() {
+			admitted++
+		}
+	}
+	if admitted != 1 {
+		t.Errorf("ERROR expected exactly 1 of 5 concurrent Allow() calls to admit a probe while one is outstanding, got %d", admitted)
+	}
+}
+
+func TestDoHTTPActionReturnsErrCircuitOpen(t *testing.T) {
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	breaker := NewCircuitBreaker()
+	breaker.MinRequests = 1
+	breaker.FailureThreshold = 0.5
+	breaker.CooldownBase = time.Minute
+	breaker.RecordResult(false)
+
+	req := NewHTTPRequest(tserv.URL)
+	req.CircuitBreaker = breaker
+
+	_, _, err := req.DoHTTPAction()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("ERROR expected ErrCircuitOpen, got %v", err)
+	}
+}
+
+func TestAdaptiveBackoffHonorsRetryAfterHeader(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "2")
+
+	wait := AdaptiveBackoff(1*time.Second, 10*time.Second, 1, resp)
+	if wait != 2*time.Second {
+		t.Errorf("ERROR expected 2s backoff from Retry-After header, got %s", wait)
+	}
+}
+
+func TestAdaptiveBackoffClampsRetryAfterToMax(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "60")
+
+	wait := AdaptiveBackoff(1*time.Second, 5*time.Second, 1, resp)
+	if wait != 5*time.Second {
+		t.Errorf("ERROR expected backoff clamped to 5s max, got %s", wait)
+	}
+}
+
+func TestMetricsSinkNotifiedOnBreakerStateChange(t *testing.T) {
+	tserv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer tserv.Close()
+
+	sink := &countingSink{}
+	breaker := NewCircuitBreaker()
+	breaker.MinRequests = 1
+	breaker.FailureThreshold = 0.5
+
+	req := NewHTTPRequest(tserv.URL)
+	req.CircuitBreaker = breaker
+	req.Metrics = sink
+	req.MaxRetryCount = 1
+	req.MaxRetryWait = 1
+
+	req.DoHTTPAction()
+
+	if sink.breakerChanges != 1 {
+		t.Errorf("ERROR expected 1 BreakerStateChanged call after the request tripped the breaker, got %d", sink.breakerChanges)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("ERROR expected breaker to be open, got %s", breaker.State())
+	}
+}
@@ -0,0 +1,439 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package hmshttp provides a convenience wrapper around
+// hashicorp/go-retryablehttp for making outgoing HTTP calls from HMS
+// services, including basic-auth support and CA-bundle aware TLS client
+// pairs for talking to services behind the platform PKI.
+package hmshttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Default values used when a HTTPRequest does not set them explicitly.
+const (
+	DefaultTimeout     = 30 * time.Second
+	DefaultContentType = "application/json"
+	DefaultRetryCount  = 3
+	DefaultRetryWait   = 5
+)
+
+// TLSClientPair holds a secure (CA-validated) and an insecure
+// (certificate-validation-skipped) retryablehttp client for the same
+// target. NewCAHTTPRequest populates this so that callers can fall back
+// to the insecure client if, e.g., the CA bundle could not be loaded.
+type TLSClientPair struct {
+	SecureClient   *retryablehttp.Client
+	InsecureClient *retryablehttp.Client
+}
+
+// HTTPRequest describes a single outgoing HTTP call along with everything
+// needed to execute and retry it. Zero-value fields fall back to sane
+// defaults (see NewHTTPRequest). Callers may also build a HTTPRequest by
+// hand for backward compatibility with code that only used retryablehttp
+// directly.
+type HTTPRequest struct {
+	Client              *retryablehttp.Client
+	Context             context.Context
+	FullURL             string
+	Method              string
+	Payload             []byte
+	Timeout             time.Duration
+	ContentType         string
+	CustomHeaders       map[string]string
+	ExpectedStatusCodes []int
+	Auth                Authenticator
+	MaxRetryCount       int
+	MaxRetryWait        int
+	TLSClientPair       TLSClientPair
+	Middleware          []Middleware
+	Metrics             MetricsSink
+	ServiceName         string
+	Operation           string
+	Watcher             *WatchedTLSClientPair
+	StreamSource        StreamSource
+	StreamSize          int64
+	SpoolThreshold      int64
+	CircuitBreaker      *CircuitBreaker
+
+	// spoolPath records the path spoolToTempFile last spooled to, for
+	// tests; cleanup itself is driven from stream.go, not here.
+	spoolPath atomic.Pointer[string]
+}
+
+// NewHTTPRequest creates a HTTPRequest for the given URL with the
+// package's default timeout, content type, and retry behavior. Method
+// defaults to GET; callers set req.Method/req.Payload as needed before
+// calling DoHTTPAction/GetBodyForHTTPRequest.
+func NewHTTPRequest(fullURL string) *HTTPRequest {
+	return &HTTPRequest{
+		Client:              retryablehttp.NewClient(),
+		Context:             context.Background(),
+		FullURL:             fullURL,
+		Method:              "GET",
+		Timeout:             DefaultTimeout,
+		ContentType:         DefaultContentType,
+		CustomHeaders:       make(map[string]string),
+		ExpectedStatusCodes: []int{http.StatusOK},
+		MaxRetryCount:       DefaultRetryCount,
+		MaxRetryWait:        DefaultRetryWait,
+	}
+}
+
+// NewCAHTTPRequest creates a HTTPRequest whose TLSClientPair is backed by
+// the CA bundle found at caBundlePath. If caBundlePath is empty, the
+// secure client falls back to the system root CA pool. The insecure
+// client always skips certificate validation, and GetBodyForHTTPRequest
+// falls back to it if the secure client has been cleared (e.g. because
+// the bundle failed to load).
+func NewCAHTTPRequest(fullURL, caBundlePath string) (*HTTPRequest, error) {
+	req := NewHTTPRequest(fullURL)
+	req.Client = nil
+
+	pair, err := newTLSClientPair(caBundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating TLS client pair: %v", err)
+	}
+	req.TLSClientPair = *pair
+	return req, nil
+}
+
+func newTLSClientPair(caBundlePath string) (*TLSClientPair, error) {
+	rootCAs := x509.NewCertPool()
+	if caBundlePath != "" {
+		bundle, err := ioutil.ReadFile(caBundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle '%s': %v", caBundlePath, err)
+		}
+		if !rootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no valid certificates found in CA bundle '%s'", caBundlePath)
+		}
+	} else {
+		sysPool, err := x509.SystemCertPool()
+		if err == nil && sysPool != nil {
+			rootCAs = sysPool
+		}
+	}
+
+	secureClient := retryablehttp.NewClient()
+	secureClient.HTTPClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+	}
+
+	insecureClient := retryablehttp.NewClient()
+	insecureClient.HTTPClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	return &TLSClientPair{SecureClient: secureClient, InsecureClient: insecureClient}, nil
+}
+
+// String renders a human-readable summary of the request, suitable for
+// debug logging before the call is made.
+func (req *HTTPRequest) String() string {
+	return fmt.Sprintf("Method: %s, URL: %s, ContentType: %s, Payload length: %d",
+		req.Method, req.FullURL, req.ContentType, len(req.Payload))
+}
+
+// sharedClient picks the long-lived *retryablehttp.Client backing this
+// request: an explicitly-set req.Client wins, then the TLS client pair's
+// secure client, then its insecure client, and finally a freshly
+// constructed default client. Unlike client(), the returned value may be
+// shared with other concurrent requests (e.g. every HTTPRequest built
+// from the same TLSClientPair) and must not be mutated.
+func (req *HTTPRequest) sharedClient() *retryablehttp.Client {
+	if req.Client != nil {
+		return req.Client
+	}
+	if req.TLSClientPair.SecureClient != nil {
+		return req.TLSClientPair.SecureClient
+	}
+	if req.TLSClientPair.InsecureClient != nil {
+		return req.TLSClientPair.InsecureClient
+	}
+	return retryablehttp.NewClient()
+}
+
+// client returns a private, per-send copy of sharedClient(): cheap, since
+// it shares the underlying *http.Client/Transport and thus its connection
+// pool, but with its own CheckRetry/Backoff/RequestLogHook/RetryMax/
+// RetryWaitMax fields. send configures those on the copy rather than
+// patching and restoring them on the shared client, so a long-lived
+// TLSClientPair reused across concurrent requests -- exactly how
+// NewCAHTTPRequest/NewWatchedCAHTTPRequest are meant to be used -- never
+// has one in-flight request's retry policy, auth-retry hook, or metrics
+// hook clobbered by a sibling request's. Built field-by-field (instead of
+// a struct copy) since retryablehttp.Client embeds sync.Once guards that
+// must not be copied while potentially in use.
+func (req *HTTPRequest) client() *retryablehttp.Client {
+	shared := req.sharedClient()
+	clientCopy := &retryablehttp.Client{
+		HTTPClient:      shared.HTTPClient,
+		Logger:          shared.Logger,
+		RetryWaitMin:    shared.RetryWaitMin,
+		RetryWaitMax:    shared.RetryWaitMax,
+		RetryMax:        shared.RetryMax,
+		RequestLogHook:  shared.RequestLogHook,
+		ResponseLogHook: shared.ResponseLogHook,
+		CheckRetry:      shared.CheckRetry,
+		Backoff:         shared.Backoff,
+		ErrorHandler:    shared.ErrorHandler,
+		PrepareRetry:    shared.PrepareRetry,
+	}
+	if req.Timeout > 0 {
+		httpClientCopy := *shared.HTTPClient
+		httpClientCopy.Timeout = req.Timeout
+		clientCopy.HTTPClient = &httpClientCopy
+	}
+	return clientCopy
+}
+
+func (req *HTTPRequest) expectedStatusCode(code int) bool {
+	if len(req.ExpectedStatusCodes) == 0 {
+		return code < 300
+	}
+	for _, exp := range req.ExpectedStatusCodes {
+		if code == exp {
+			return true
+		}
+	}
+	return false
+}
+
+// buildRequest turns req into a *retryablehttp.Request with headers, auth,
+// and body (streamed or buffered) applied, along with the resolved
+// method for use in logging/error messages.
+func (req *HTTPRequest) buildRequest() (*retryablehttp.Request, string, error) {
+	if req.FullURL == "" {
+		return nil, "", fmt.Errorf("no URL specified for HTTP request")
+	}
+
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	var rawBody interface{}
+	switch {
+	case req.StreamSource != nil:
+		rawBody = retryablehttp.ReaderFunc(func() (io.Reader, error) {
+			rc, err := req.StreamSource()
+			if err != nil {
+				return nil, err
+			}
+			return rc, nil
+		})
+	case len(req.Payload) > 0:
+		rawBody = req.Payload
+	}
+
+	rreq, err := retryablehttp.NewRequest(method, req.FullURL, rawBody)
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating request: %v", err)
+	}
+	if req.StreamSource != nil && req.StreamSize > 0 {
+		rreq.ContentLength = req.StreamSize
+	}
+
+	ctx := req.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rreq = rreq.WithContext(ctx)
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	rreq.Header.Set("Content-Type", contentType)
+
+	for k, v := range req.CustomHeaders {
+		rreq.Header.Set(k, v)
+	}
+
+	if req.Auth != nil {
+		if err := req.Auth.Apply(rreq); err != nil {
+			return nil, "", fmt.Errorf("error applying authenticator: %v", err)
+		}
+	}
+
+	return rreq, method, nil
+}
+
+// send dispatches rreq through the configured client, middleware chain,
+// and metrics/auth-retry instrumentation.
+func (req *HTTPRequest) send(rreq *retryablehttp.Request, method string) (*http.Response, error) {
+	client := req.client()
+	if req.MaxRetryCount > 0 {
+		client.RetryMax = req.MaxRetryCount
+	}
+	if req.MaxRetryWait > 0 {
+		client.RetryWaitMax = time.Duration(req.MaxRetryWait) * time.Second
+	}
+	req.applyAdaptiveRetryPolicy(client)
+	req.wrapAuthRetry(client)
+
+	host := rreq.URL.Host
+	breaker := req.breaker(host)
+	allowed, beforeState := breaker.allow()
+	if !allowed {
+		if req.Metrics != nil {
+			req.Metrics.BreakerStateChanged(host, beforeState, breaker.State())
+		}
+		return nil, ErrCircuitOpen
+	}
+
+	if req.Metrics != nil {
+		req.Metrics.RequestStarted(method, host, req.ServiceName, req.Operation)
+		req.instrumentRetries(client, method, host)
+	}
+
+	start := time.Now()
+	sendFn := chainMiddleware(req.middlewareChain(), client.Do)
+	resp, err := sendFn(rreq)
+	duration := time.Since(start)
+
+	success := err == nil && resp != nil && req.expectedStatusCode(resp.StatusCode)
+	afterState := breaker.RecordResult(success)
+	if req.Metrics != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		req.Metrics.RequestCompleted(method, host, req.ServiceName, req.Operation, status, duration)
+		if afterState != beforeState {
+			req.Metrics.BreakerStateChanged(host, beforeState, afterState)
+		}
+	}
+
+	return resp, err
+}
+
+// DoHTTPAction executes the HTTP request described by req, applying
+// headers, auth, timeout, and retry settings, and returns the raw
+// *http.Response along with the fully-read response body. Callers that
+// just want the body as JSON should use GetBodyForHTTPRequest instead.
+// Large responses should use DoStreamingHTTPAction, which never buffers
+// the body in memory. If the target host's CircuitBreaker is tripped,
+// DoHTTPAction returns ErrCircuitOpen immediately instead of spending
+// MaxRetryCount against a peer already known to be down.
+func (req *HTTPRequest) DoHTTPAction() (*http.Response, json.RawMessage, error) {
+	rreq, method, err := req.buildRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := req.send(rreq, method)
+	if errors.Is(err, ErrCircuitOpen) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error executing %s %s: %v", method, req.FullURL, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	if !req.expectedStatusCode(resp.StatusCode) {
+		return resp, respBody, fmt.Errorf("unexpected status code %d from %s %s", resp.StatusCode, method, req.FullURL)
+	}
+
+	return resp, respBody, nil
+}
+
+// DoStreamingHTTPAction executes req and copies the response body
+// directly into sink as it's received, instead of buffering it in
+// memory -- use this for firmware images, log bundles, or other large
+// payloads where GetBodyForHTTPRequest would otherwise hold the whole
+// response in RAM. Use SetStreamingPayload/SetStreamingSource to stream
+// a large request body the same way. If the target host's CircuitBreaker
+// is tripped, DoStreamingHTTPAction returns ErrCircuitOpen immediately.
+func (req *HTTPRequest) DoStreamingHTTPAction(sink io.Writer) (*http.Response, error) {
+	rreq, method, err := req.buildRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := req.send(rreq, method)
+	if errors.Is(err, ErrCircuitOpen) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error executing %s %s: %v", method, req.FullURL, err)
+	}
+	defer resp.Body.Close()
+
+	if !req.expectedStatusCode(resp.StatusCode) {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp, fmt.Errorf("unexpected status code %d from %s %s", resp.StatusCode, method, req.FullURL)
+	}
+
+	if _, err := io.Copy(sink, resp.Body); err != nil {
+		return resp, fmt.Errorf("error streaming response body: %v", err)
+	}
+
+	return resp, nil
+}
+
+// instrumentRetries wraps client's RequestLogHook to report each retry
+// attempt to req.Metrics separately from the outer request, since
+// retryablehttp otherwise swallows the intermediate failures. client is
+// always send's private per-call copy, so this never touches a hook a
+// caller-supplied client relies on elsewhere.
+func (req *HTTPRequest) instrumentRetries(client *retryablehttp.Client, method, host string) {
+	prevHook := client.RequestLogHook
+	client.RequestLogHook = func(logger retryablehttp.Logger, r *http.Request, attempt int) {
+		if attempt > 0 {
+			req.Metrics.RetryAttempted(method, host, req.ServiceName, req.Operation)
+		}
+		if prevHook != nil {
+			prevHook(logger, r, attempt)
+		}
+	}
+}
+
+// GetBodyForHTTPRequest executes req and returns the response body as a
+// json.RawMessage, or an error if the request failed or returned an
+// unexpected status code.
+func (req *HTTPRequest) GetBodyForHTTPRequest() (json.RawMessage, error) {
+	_, body, err := req.DoHTTPAction()
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(body), nil
+}
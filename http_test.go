@@ -29,6 +29,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -302,3 +303,41 @@ func TestManualHttp(t *testing.T) {
 			jpayload, string(ba))
 	}
 }
+
+// TestConcurrentRequestsSharingTLSClientPairDoNotRace is the regression
+// test for a bug where send() configured CheckRetry/Backoff/
+// RequestLogHook directly on the shared *retryablehttp.Client backing a
+// TLSClientPair, then restored them via defer once the call finished --
+// safe only if each HTTPRequest owned a private client, which is not how
+// NewCAHTTPRequest/NewWatchedCAHTTPRequest are meant to be used. Run
+// under `go test -race` to catch the data race directly; this also
+// asserts every concurrent call still completes successfully.
+func TestConcurrentRequestsSharingTLSClientPairDoNotRace(t *testing.T) {
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	pair, err := newTLSClientPair("")
+	if err != nil {
+		t.Fatalf("ERROR creating TLS client pair: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := NewHTTPRequest(tserv.URL)
+			req.Client = nil
+			req.TLSClientPair = *pair
+			if i%2 == 0 {
+				req.Auth = &Auth{Username: "user", Password: "pass"}
+			}
+
+			if _, err := req.GetBodyForHTTPRequest(); err != nil {
+				t.Errorf("ERROR from concurrent GetBodyForHTTPRequest(): %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,120 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsSink receives instrumentation events from DoHTTPAction. Host is
+// the target's host:port, and service/operation are the caller-supplied
+// HTTPRequest.ServiceName/Operation used to label metrics without
+// parsing the URL. Implementations must be safe for concurrent use.
+type MetricsSink interface {
+	// RequestStarted is called once per outer request, before the first
+	// attempt (including any retries) is sent.
+	RequestStarted(method, host, service, operation string)
+	// RequestCompleted is called once per outer request, after the last
+	// attempt finishes, with the final status code (0 if the request
+	// never got a response) and the end-to-end duration including any
+	// retry backoff.
+	RequestCompleted(method, host, service, operation string, statusCode int, duration time.Duration)
+	// RetryAttempted is called for each retry retryablehttp performs
+	// beyond the first attempt, since retryablehttp does not otherwise
+	// surface intermediate failures to the caller.
+	RetryAttempted(method, host, service, operation string)
+	// BreakerStateChanged is called whenever host's CircuitBreaker
+	// transitions between closed/open/half-open, as observed by a
+	// request that just ran Allow/RecordResult against it.
+	BreakerStateChanged(host string, from, to BreakerState)
+}
+
+// PrometheusMetrics is a MetricsSink backed by a *prometheus.Registry. It
+// tracks request totals, retries, an in-flight gauge, and end-to-end
+// latency, all labeled by method, host, service, and operation.
+type PrometheusMetrics struct {
+	requestsTotal *prometheus.CounterVec
+	retriesTotal  *prometheus.CounterVec
+	inFlight      *prometheus.GaugeVec
+	latency       *prometheus.HistogramVec
+	breakerState  *prometheus.GaugeVec
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics and registers its
+// collectors with reg.
+func NewPrometheusMetrics(reg *prometheus.Registry) *PrometheusMetrics {
+	labels := []string{"method", "host", "service", "operation"}
+
+	m := &PrometheusMetrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hmshttp",
+			Name:      "requests_total",
+			Help:      "Total outgoing HTTP requests, labeled by final status code.",
+		}, append(labels, "status")),
+		retriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hmshttp",
+			Name:      "request_retries_total",
+			Help:      "Total retry attempts performed by the retryablehttp client, excluding the initial attempt.",
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "hmshttp",
+			Name:      "requests_in_flight",
+			Help:      "Number of outgoing HTTP requests currently in flight.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "hmshttp",
+			Name:      "request_duration_seconds",
+			Help:      "End-to-end latency of outgoing HTTP requests, including retry backoff.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "hmshttp",
+			Name:      "circuit_breaker_state",
+			Help:      "Current CircuitBreaker state per host: 0=closed, 1=open, 2=half-open.",
+		}, []string{"host"}),
+	}
+
+	reg.MustRegister(m.requestsTotal, m.retriesTotal, m.inFlight, m.latency, m.breakerState)
+	return m
+}
+
+func (m *PrometheusMetrics) RequestStarted(method, host, service, operation string) {
+	m.inFlight.WithLabelValues(method, host, service, operation).Inc()
+}
+
+func (m *PrometheusMetrics) RequestCompleted(method, host, service, operation string, statusCode int, duration time.Duration) {
+	m.inFlight.WithLabelValues(method, host, service, operation).Dec()
+	m.requestsTotal.WithLabelValues(method, host, service, operation, strconv.Itoa(statusCode)).Inc()
+	m.latency.WithLabelValues(method, host, service, operation).Observe(duration.Seconds())
+}
+
+func (m *PrometheusMetrics) RetryAttempted(method, host, service, operation string) {
+	m.retriesTotal.WithLabelValues(method, host, service, operation).Inc()
+}
+
+func (m *PrometheusMetrics) BreakerStateChanged(host string, from, to BreakerState) {
+	m.breakerState.WithLabelValues(host).Set(float64(to))
+}
@@ -0,0 +1,155 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type countingSink struct {
+	started, completed, retries, breakerChanges int
+	lastCode                                    int
+}
+
+func (s *countingSink) RequestStarted(method, host, service, operation string) {
+	s.started++
+}
+
+func (s *countingSink) RequestCompleted(method, host, service, operation string, statusCode int, duration time.Duration) {
+	s.completed++
+	s.lastCode = statusCode
+}
+
+func (s *countingSink) RetryAttempted(method, host, service, operation string) {
+	s.retries++
+}
+
+func (s *countingSink) BreakerStateChanged(host string, from, to BreakerState) {
+	s.breakerChanges++
+}
+
+func TestMetricsSinkCalledOnSuccess(t *testing.T) {
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	sink := &countingSink{}
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Method = "GET"
+	req.Metrics = sink
+	req.ServiceName = "smd"
+	req.Operation = "GetComponents"
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+
+	if sink.started != 1 {
+		t.Errorf("ERROR expected 1 RequestStarted call, got %d", sink.started)
+	}
+	if sink.completed != 1 {
+		t.Errorf("ERROR expected 1 RequestCompleted call, got %d", sink.completed)
+	}
+	if sink.lastCode != http.StatusOK {
+		t.Errorf("ERROR expected status %d, got %d", http.StatusOK, sink.lastCode)
+	}
+}
+
+func TestMetricsSinkCountsRetriesSeparatelyFromRequest(t *testing.T) {
+	var attempts int32
+	tserv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(jpayload))
+	}))
+	defer tserv.Close()
+
+	sink := &countingSink{}
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Metrics = sink
+	req.MaxRetryCount = 2
+	req.MaxRetryWait = 1
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+
+	if sink.retries != 1 {
+		t.Errorf("ERROR expected 1 RetryAttempted call for the single failed attempt, got %d", sink.retries)
+	}
+	if sink.started != 1 {
+		t.Errorf("ERROR expected 1 RequestStarted call for the outer request, counted separately from its retry, got %d", sink.started)
+	}
+	if sink.completed != 1 {
+		t.Errorf("ERROR expected 1 RequestCompleted call for the outer request, got %d", sink.completed)
+	}
+}
+
+func TestPrometheusMetricsRegistersCollectors(t *testing.T) {
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	reg := prometheus.NewRegistry()
+	metrics := NewPrometheusMetrics(reg)
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Method = "GET"
+	req.Metrics = metrics
+	req.ServiceName = "smd"
+	req.Operation = "GetComponents"
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("ERROR gathering metrics: %v", err)
+	}
+
+	var sawRequestsTotal, sawLatency bool
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "hmshttp_requests_total":
+			sawRequestsTotal = len(mf.GetMetric()) > 0
+		case "hmshttp_request_duration_seconds":
+			sawLatency = len(mf.GetMetric()) > 0
+		}
+	}
+	if !sawRequestsTotal {
+		t.Errorf("ERROR expected hmshttp_requests_total to have samples")
+	}
+	if !sawLatency {
+		t.Errorf("ERROR expected hmshttp_request_duration_seconds to have samples")
+	}
+}
@@ -0,0 +1,117 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"net/http"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/sirupsen/logrus"
+)
+
+// RoundTripFunc is the terminal function a Middleware chain eventually
+// calls into to actually send the request -- normally the retryablehttp
+// client's Do, but tests may substitute their own to short-circuit with
+// a canned response.
+type RoundTripFunc func(req *retryablehttp.Request) (*http.Response, error)
+
+// Middleware wraps a RoundTripFunc so callers can inspect or modify the
+// outgoing *retryablehttp.Request, inspect the *http.Response on the way
+// back, or short-circuit the call entirely by not invoking next.
+// Middleware is applied once per HTTPRequest, not once per retry attempt,
+// so request-ID/audit-log middleware sees the retries retryablehttp
+// performs internally as a single logical call.
+type Middleware func(req *retryablehttp.Request, next RoundTripFunc) (*http.Response, error)
+
+// DefaultMiddleware is applied to every HTTPRequest whose own Middleware
+// slice is empty. Append to it (e.g. in an init func) to affect every
+// request made through this package; set HTTPRequest.Middleware directly
+// to override it for a specific request. Because TLSClientPair only
+// selects which retryablehttp.Client sends the request, both the secure
+// and insecure clients run through the same chain.
+var DefaultMiddleware []Middleware
+
+// middlewareChain returns the Middleware slice to apply to req.
+func (req *HTTPRequest) middlewareChain() []Middleware {
+	if len(req.Middleware) > 0 {
+		return req.Middleware
+	}
+	return DefaultMiddleware
+}
+
+// chainMiddleware composes mw into a single RoundTripFunc terminating in
+// final. mw[0] is outermost: it sees the request first and the response
+// last.
+func chainMiddleware(mw []Middleware, final RoundTripFunc) RoundTripFunc {
+	rt := final
+	for i := len(mw) - 1; i >= 0; i-- {
+		m := mw[i]
+		next := rt
+		rt = func(req *retryablehttp.Request) (*http.Response, error) {
+			return m(req, next)
+		}
+	}
+	return rt
+}
+
+// NewCorrelationIDMiddleware returns a Middleware that ensures every
+// outgoing request carries header, generating a value with genID when
+// the caller hasn't already set one via CustomHeaders.
+func NewCorrelationIDMiddleware(header string, genID func() string) Middleware {
+	return func(req *retryablehttp.Request, next RoundTripFunc) (*http.Response, error) {
+		if req.Header.Get(header) == "" && genID != nil {
+			req.Header.Set(header, genID())
+		}
+		return next(req)
+	}
+}
+
+// NewHeaderPropagationMiddleware returns a Middleware that copies the
+// given headers onto every outgoing request, e.g. to forward a tenant or
+// trace header received on an inbound request without threading it
+// through every call site.
+func NewHeaderPropagationMiddleware(headers map[string]string) Middleware {
+	return func(req *retryablehttp.Request, next RoundTripFunc) (*http.Response, error) {
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return next(req)
+	}
+}
+
+// NewLoggingMiddleware returns a Middleware that logs each outgoing
+// request and its outcome via log.
+func NewLoggingMiddleware(log logrus.FieldLogger) Middleware {
+	return func(req *retryablehttp.Request, next RoundTripFunc) (*http.Response, error) {
+		fields := logrus.Fields{"method": req.Method, "url": req.URL.String()}
+
+		resp, err := next(req)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("HTTP request failed")
+			return resp, err
+		}
+
+		log.WithFields(fields).WithField("status", resp.StatusCode).Debug("HTTP request completed")
+		return resp, nil
+	}
+}
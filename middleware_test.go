@@ -0,0 +1,92 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+func TestMiddlewareChainOrderAndHeaders(t *testing.T) {
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	var order []string
+
+	mark := func(name string) Middleware {
+		return func(req *retryablehttp.Request, next RoundTripFunc) (*http.Response, error) {
+			order = append(order, name+":before")
+			resp, err := next(req)
+			order = append(order, name+":after")
+			return resp, err
+		}
+	}
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Method = "GET"
+	req.Middleware = []Middleware{
+		mark("outer"),
+		NewHeaderPropagationMiddleware(map[string]string{"X-Tenant": "acme"}),
+		NewCorrelationIDMiddleware("X-Correlation-Id", func() string { return "test-id" }),
+		mark("inner"),
+	}
+
+	_, err := req.GetBodyForHTTPRequest()
+	if err != nil {
+		t.Fatalf("ERROR from GetBodyForHTTPRequest(): %v", err)
+	}
+
+	expected := []string{"outer:before", "inner:before", "inner:after", "outer:after"}
+	if len(order) != len(expected) {
+		t.Fatalf("ERROR wrong middleware call order, exp: %v, got: %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("ERROR wrong middleware call order, exp: %v, got: %v", expected, order)
+			break
+		}
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	canned := &http.Response{StatusCode: http.StatusTeapot, Body: http.NoBody, Header: make(http.Header)}
+
+	req := NewHTTPRequest("http://localhost/unused")
+	req.ExpectedStatusCodes = []int{http.StatusTeapot}
+	req.Middleware = []Middleware{
+		func(req *retryablehttp.Request, next RoundTripFunc) (*http.Response, error) {
+			return canned, nil
+		},
+	}
+
+	resp, _, err := req.DoHTTPAction()
+	if err != nil {
+		t.Fatalf("ERROR from DoHTTPAction(): %v", err)
+	}
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("ERROR expected short-circuited status %d, got %d", http.StatusTeapot, resp.StatusCode)
+	}
+}
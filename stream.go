@@ -0,0 +1,184 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// DefaultSpoolThreshold is the payload size above which
+// SetStreamingPayload spools a non-seekable source to a temp file on its
+// first read, so a retry can reopen the spool file instead of replaying
+// an already-consumed reader entirely from memory.
+const DefaultSpoolThreshold = 32 * 1024 * 1024 // 32MiB
+
+// StreamSource produces a fresh io.ReadCloser for a streamed request
+// body. It is called once per send attempt -- including the initial
+// one retryablehttp probes at request-construction time -- so retries
+// can re-open a file path, an in-memory payload, or any other
+// repeatable source instead of replaying a reader that's already been
+// consumed.
+type StreamSource func() (io.ReadCloser, error)
+
+// NewFileStreamSource returns a StreamSource that reopens path on every
+// attempt, so retries read the file from the start.
+func NewFileStreamSource(path string) StreamSource {
+	return func() (io.ReadCloser, error) { return os.Open(path) }
+}
+
+// NewBytesStreamSource returns a StreamSource that hands out a fresh
+// reader over the same in-memory payload on every attempt.
+func NewBytesStreamSource(data []byte) StreamSource {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// SetStreamingSource configures req to stream the body src produces,
+// called fresh on every attempt, instead of buffering it into
+// req.Payload. size is advertised via Content-Length when greater than
+// zero. Use NewFileStreamSource/NewBytesStreamSource for the common
+// cases, or a custom StreamSource for anything else repeatable.
+func (req *HTTPRequest) SetStreamingSource(src StreamSource, size int64) {
+	req.StreamSource = src
+	req.StreamSize = size
+}
+
+// SetStreamingPayload configures req to stream src as the request body
+// instead of buffering it into req.Payload, for large uploads (firmware
+// images, log bundles, inventory dumps) that shouldn't be held in
+// memory twice. size is advertised via Content-Length when greater than
+// zero.
+//
+// If src is also an io.Seeker, retries rewind it with Seek(0,
+// io.SeekStart) -- cheap and safe for an *os.File. Otherwise src can
+// only be read once; if size is unknown or exceeds SpoolThreshold (or
+// DefaultSpoolThreshold if unset), req spools it to a temp file on
+// first read so a retry -- or a later call to DoHTTPAction/
+// DoStreamingHTTPAction reusing the same req -- can reopen that file
+// instead. The spool file is removed when req.Context is canceled, or
+// otherwise once nothing holds onto it any longer (see spoolToTempFile).
+// Smaller, known-size payloads are buffered in memory instead, same as a
+// []byte Payload.
+func (req *HTTPRequest) SetStreamingPayload(src io.Reader, size int64) {
+	req.StreamSize = size
+
+	if seeker, ok := src.(io.ReadSeeker); ok {
+		req.StreamSource = func() (io.ReadCloser, error) {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("error rewinding streaming payload: %v", err)
+			}
+			return ioutil.NopCloser(seeker), nil
+		}
+		return
+	}
+
+	threshold := req.SpoolThreshold
+	if threshold <= 0 {
+		threshold = DefaultSpoolThreshold
+	}
+
+	if size > 0 && size <= threshold {
+		data, err := ioutil.ReadAll(src)
+		if err != nil {
+			req.StreamSource = func() (io.ReadCloser, error) { return nil, err }
+			return
+		}
+		req.StreamSource = NewBytesStreamSource(data)
+		return
+	}
+
+	req.StreamSource = req.spoolToTempFile(src)
+}
+
+// spoolHandle is the sole reference a StreamSource built by
+// spoolToTempFile keeps on its backing temp file. As long as it's
+// reachable -- in practice, kept alive by the req.StreamSource closure
+// below, itself reachable for as long as the owning *HTTPRequest is --
+// the file stays put so a retry, or a later DoHTTPAction/
+// DoStreamingHTTPAction call reusing the same req, can reopen it. Once
+// the request is dropped without ever being reused, nothing references
+// the handle any longer and its finalizer removes the file, so a
+// one-shot upload that never bothers to attach a cancelable Context
+// doesn't leak its spool file under os.TempDir() forever.
+type spoolHandle struct {
+	path string
+}
+
+// spoolToTempFile copies src to a temp file the first time the returned
+// StreamSource is called, then reopens that file on every call
+// afterward -- including retries -- so an arbitrarily large, one-shot
+// reader never needs to live twice in memory. The temp file is removed
+// once req.Context is canceled, or -- see spoolHandle -- once the
+// request that spooled it is no longer reachable.
+func (req *HTTPRequest) spoolToTempFile(src io.Reader) StreamSource {
+	var once sync.Once
+	var handle *spoolHandle
+	var spoolErr error
+
+	spool := func() {
+		f, err := ioutil.TempFile("", "hmshttp-spool-*")
+		if err != nil {
+			spoolErr = fmt.Errorf("error creating spool file: %v", err)
+			return
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(f, src); err != nil {
+			spoolErr = fmt.Errorf("error spooling payload to '%s': %v", f.Name(), err)
+			os.Remove(f.Name())
+			return
+		}
+
+		handle = &spoolHandle{path: f.Name()}
+		req.spoolPath.Store(&handle.path)
+		runtime.SetFinalizer(handle, func(h *spoolHandle) { os.Remove(h.path) })
+
+		// ctx.Done() is nil for context.Background()/context.TODO() --
+		// including the default NewHTTPRequest sets -- so only spawn the
+		// watcher for a context that can actually be canceled; otherwise
+		// it would block forever and, by holding handle in its closure,
+		// pin the spool file past the point spoolHandle's finalizer
+		// could otherwise reclaim it.
+		if ctx := req.Context; ctx != nil && ctx.Done() != nil {
+			go func() {
+				<-ctx.Done()
+				os.Remove(handle.path)
+			}()
+		}
+	}
+
+	return func() (io.ReadCloser, error) {
+		once.Do(spool)
+		if spoolErr != nil {
+			return nil, spoolErr
+		}
+		return os.Open(handle.path)
+	}
+}
@@ -0,0 +1,212 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoStreamingHTTPActionDownload(t *testing.T) {
+	const want = "this is a large firmware-image-shaped response body"
+	tserv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(want))
+	}))
+	defer tserv.Close()
+
+	var sink bytes.Buffer
+	req := NewHTTPRequest(tserv.URL)
+	if _, err := req.DoStreamingHTTPAction(&sink); err != nil {
+		t.Fatalf("ERROR from DoStreamingHTTPAction(): %v", err)
+	}
+	if sink.String() != want {
+		t.Errorf("ERROR data miscompare, exp: '%s', got '%s'", want, sink.String())
+	}
+}
+
+func TestStreamingPayloadRetriesFromFileSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "payload.bin")
+	payload := []byte("retry-me-from-the-start")
+	if err := os.WriteFile(path, payload, 0644); err != nil {
+		t.Fatalf("ERROR writing payload file: %v", err)
+	}
+
+	var attempts int32
+	tserv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("ERROR reading request body: %v", err)
+		}
+		if !bytes.Equal(body, payload) {
+			t.Errorf("ERROR attempt %d got wrong body: '%s'", n, body)
+		}
+		if n < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer tserv.Close()
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Method = "POST"
+	req.MaxRetryCount = 2
+	req.MaxRetryWait = 1
+	req.ExpectedStatusCodes = []int{http.StatusOK}
+	req.SetStreamingSource(NewFileStreamSource(path), int64(len(payload)))
+
+	if _, _, err := req.DoHTTPAction(); err != nil {
+		t.Fatalf("ERROR from DoHTTPAction(): %v", err)
+	}
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("ERROR expected exactly 2 attempts, got %d", attempts)
+	}
+}
+
+func TestSetStreamingPayloadSpoolsLargeNonSeekableSource(t *testing.T) {
+	payload := []byte("spool me to disk since I'm not seekable")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req := NewHTTPRequest("http://localhost/unused")
+	req.Context = ctx
+	req.SpoolThreshold = 1 // force spooling regardless of size
+	req.SetStreamingPayload(io.NopCloser(bytes.NewReader(payload)), int64(len(payload)))
+
+	rc, err := req.StreamSource()
+	if err != nil {
+		t.Fatalf("ERROR opening spooled stream source: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("ERROR reading spooled stream source: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("ERROR data miscompare, exp: '%s', got '%s'", payload, got)
+	}
+
+	// A second open (as a retry would do) must re-read the same data.
+	rc2, err := req.StreamSource()
+	if err != nil {
+		t.Fatalf("ERROR re-opening spooled stream source: %v", err)
+	}
+	got2, err := io.ReadAll(rc2)
+	rc2.Close()
+	if err != nil {
+		t.Fatalf("ERROR re-reading spooled stream source: %v", err)
+	}
+	if !bytes.Equal(got2, payload) {
+		t.Errorf("ERROR data miscompare on reopen, exp: '%s', got '%s'", payload, got2)
+	}
+
+	cancel()
+	// Give the cleanup goroutine a moment to remove the spool file.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := req.StreamSource(); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("ERROR expected spool file to be removed after context cancellation")
+}
+
+// TestSetStreamingPayloadSpoolFileSurvivesRequestReuse confirms that
+// completing a streamed upload doesn't strand the spool file in a state
+// where reusing the same req for a second DoHTTPAction call fails -- a
+// regression an earlier, more eager cleanup attempt introduced by
+// deleting the spool file as soon as the first call finished.
+func TestSetStreamingPayloadSpoolFileSurvivesRequestReuse(t *testing.T) {
+	payload := []byte("spool me to disk and let me be resent")
+
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	req := NewHTTPRequest(tserv.URL)
+	req.Method = "POST"
+	req.SpoolThreshold = 1 // force spooling regardless of size
+	req.SetStreamingPayload(io.NopCloser(bytes.NewReader(payload)), int64(len(payload)))
+
+	if _, _, err := req.DoHTTPAction(); err != nil {
+		t.Fatalf("ERROR from first DoHTTPAction(): %v", err)
+	}
+	if _, _, err := req.DoHTTPAction(); err != nil {
+		t.Fatalf("ERROR from second DoHTTPAction() reusing the same req: %v", err)
+	}
+}
+
+// TestSetStreamingPayloadSpoolFileRemovedOnceRequestIsUnreachable is the
+// regression test for a leak where the spool file was only ever removed
+// on req.Context cancellation -- NewHTTPRequest defaults Context to the
+// never-canceled context.Background(), so a one-shot upload via
+// SetStreamingPayload that doesn't go out of its way to attach a
+// cancelable context (the common case) leaked its spool file under
+// os.TempDir() forever. Once the caller drops req instead of reusing it,
+// the spool file's finalizer should reclaim it.
+func TestSetStreamingPayloadSpoolFileRemovedOnceRequestIsUnreachable(t *testing.T) {
+	payload := []byte("spool me to disk and clean me up once I'm unreachable")
+
+	tserv := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	var path string
+	func() {
+		req := NewHTTPRequest(tserv.URL)
+		req.Method = "POST"
+		req.SpoolThreshold = 1 // force spooling regardless of size
+		req.SetStreamingPayload(io.NopCloser(bytes.NewReader(payload)), int64(len(payload)))
+
+		if _, _, err := req.DoHTTPAction(); err != nil {
+			t.Fatalf("ERROR from DoHTTPAction(): %v", err)
+		}
+
+		p := req.spoolPath.Load()
+		if p == nil {
+			t.Fatalf("ERROR expected a spool file to have been created")
+		}
+		path = *p
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("ERROR expected spool file '%s' to be removed once unreachable", path)
+}
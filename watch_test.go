@@ -0,0 +1,235 @@
+// MIT License
+//
+// (C) Copyright [2020-2021,2024] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package hmshttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchedCAHTTPRequestReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "cabundle.crt")
+
+	orig, err := ioutil.ReadFile("./test_cabundle.crt")
+	if err != nil {
+		t.Fatalf("ERROR reading fixture CA bundle: %v", err)
+	}
+	if err := ioutil.WriteFile(caPath, orig, 0644); err != nil {
+		t.Fatalf("ERROR writing initial CA bundle: %v", err)
+	}
+
+	reloaded := make(chan error, 4)
+	req, err := NewWatchedCAHTTPRequest("http://localhost/test", caPath,
+		WithDebounce(10*time.Millisecond),
+		WithReloadCallback(func(err error) { reloaded <- err }))
+	if err != nil {
+		t.Fatalf("ERROR creating watched CA HTTP request: %v", err)
+	}
+	defer req.Watcher.Close()
+
+	if req.Watcher.tlsConfig.Load() == nil {
+		t.Fatalf("ERROR expected root CA pool to be populated after construction")
+	}
+
+	// Simulate an editor's write-then-rename: write a replacement file
+	// and rename it over the watched path.
+	replacement := filepath.Join(dir, "cabundle.crt.tmp")
+	if err := ioutil.WriteFile(replacement, orig, 0644); err != nil {
+		t.Fatalf("ERROR writing replacement CA bundle: %v", err)
+	}
+	if err := os.Rename(replacement, caPath); err != nil {
+		t.Fatalf("ERROR renaming replacement CA bundle into place: %v", err)
+	}
+
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Errorf("ERROR from fsnotify-triggered reload: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ERROR timed out waiting for fsnotify-triggered reload")
+	}
+}
+
+func TestWatchedCAHTTPRequestReloadKeepsOldTrustOnError(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "cabundle.crt")
+
+	orig, err := ioutil.ReadFile("./test_cabundle.crt")
+	if err != nil {
+		t.Fatalf("ERROR reading fixture CA bundle: %v", err)
+	}
+	if err := ioutil.WriteFile(caPath, orig, 0644); err != nil {
+		t.Fatalf("ERROR writing initial CA bundle: %v", err)
+	}
+
+	req, err := NewWatchedCAHTTPRequest("http://localhost/test", caPath)
+	if err != nil {
+		t.Fatalf("ERROR creating watched CA HTTP request: %v", err)
+	}
+	defer req.Watcher.Close()
+
+	goodConfig := req.Watcher.tlsConfig.Load()
+
+	if err := ioutil.WriteFile(caPath, []byte("not a cert"), 0644); err != nil {
+		t.Fatalf("ERROR corrupting CA bundle: %v", err)
+	}
+
+	if err := req.Watcher.Reload(); err == nil {
+		t.Errorf("ERROR expected Reload() to fail on a corrupt bundle")
+	}
+
+	if req.Watcher.tlsConfig.Load() != goodConfig {
+		t.Errorf("ERROR expected the previous trust store to be left in place after a failed reload")
+	}
+}
+
+// TestWatchedCAHTTPRequestDialUsesLoadedCABundle performs a real TLS
+// handshake through the watched secure client against an httptest TLS
+// server, rather than asserting against the in-process atomics the way
+// the other tests do. This is the regression test for a bug where the
+// loaded CA bundle was wired up via tls.Config.GetConfigForClient, which
+// net/http.Transport's client-side dial never consults -- every dial
+// silently fell back to the system root pool, which doesn't trust
+// httptest's self-signed certificate, so this test fails on that code
+// path and only passes once the bundle is actually used to dial.
+func TestWatchedCAHTTPRequestDialUsesLoadedCABundle(t *testing.T) {
+	tserv := httptest.NewTLSServer(http.HandlerFunc(handlerFunc))
+	defer tserv.Close()
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "cabundle.crt")
+	// test_cabundle.crt is the Go stdlib's localhost test cert, the same
+	// one httptest.NewTLSServer uses by default (see TestCAHttp2).
+	orig, err := ioutil.ReadFile("./test_cabundle.crt")
+	if err != nil {
+		t.Fatalf("ERROR reading fixture CA bundle: %v", err)
+	}
+	if err := ioutil.WriteFile(caPath, orig, 0644); err != nil {
+		t.Fatalf("ERROR writing CA bundle: %v", err)
+	}
+
+	req, err := NewWatchedCAHTTPRequest(tserv.URL, caPath)
+	if err != nil {
+		t.Fatalf("ERROR creating watched CA HTTP request: %v", err)
+	}
+	defer req.Watcher.Close()
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR expected the watched secure client to dial using the loaded CA bundle, got: %v", err)
+	}
+}
+
+// TestWatchedCAHTTPRequestPresentsClientCertificate is the mTLS half of
+// the same regression: a reloaded client keypair must actually be
+// presented on the next dial, not just stored in an atomic nobody reads.
+func TestWatchedCAHTTPRequestPresentsClientCertificate(t *testing.T) {
+	clientCertPEM, clientKeyPEM := generateSelfSignedCertPEM(t, "watch-test-client")
+
+	dir := t.TempDir()
+	clientCertPath := filepath.Join(dir, "client.crt")
+	clientKeyPath := filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(clientCertPath, clientCertPEM, 0644); err != nil {
+		t.Fatalf("ERROR writing client cert: %v", err)
+	}
+	if err := ioutil.WriteFile(clientKeyPath, clientKeyPEM, 0600); err != nil {
+		t.Fatalf("ERROR writing client key: %v", err)
+	}
+
+	var sawClientCert bool
+	tserv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawClientCert = r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(jpayload))
+	}))
+	tserv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	tserv.StartTLS()
+	defer tserv.Close()
+
+	caPath := filepath.Join(dir, "cabundle.crt")
+	orig, err := ioutil.ReadFile("./test_cabundle.crt")
+	if err != nil {
+		t.Fatalf("ERROR reading fixture CA bundle: %v", err)
+	}
+	if err := ioutil.WriteFile(caPath, orig, 0644); err != nil {
+		t.Fatalf("ERROR writing CA bundle: %v", err)
+	}
+
+	req, err := NewWatchedCAHTTPRequest(tserv.URL, caPath, WithClientCertificate(clientCertPath, clientKeyPath))
+	if err != nil {
+		t.Fatalf("ERROR creating watched CA HTTP request: %v", err)
+	}
+	defer req.Watcher.Close()
+
+	if _, err := req.GetBodyForHTTPRequest(); err != nil {
+		t.Fatalf("ERROR expected the watched secure client to dial successfully presenting its client cert, got: %v", err)
+	}
+	if !sawClientCert {
+		t.Errorf("ERROR expected the server to see a client certificate, but it didn't")
+	}
+}
+
+func generateSelfSignedCertPEM(t *testing.T, commonName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ERROR generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("ERROR creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("ERROR marshaling key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}